@@ -0,0 +1,239 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package remotecluster
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-server/v5/mlog"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/store"
+)
+
+const (
+	// DiscoverySourceGossip marks RemoteCluster rows that were created or
+	// refreshed via the memberlist gossip group rather than a manual POST.
+	DiscoverySourceGossip = "gossip"
+
+	reconcileInterval = time.Minute
+)
+
+// DiscoveryConfig controls how a node joins the cross-cluster gossip group.
+type DiscoveryConfig struct {
+	Enabled       bool
+	ClusterName   string
+	SharedSecret  string
+	BindAddr      string
+	BindPort      int
+	AdvertiseAddr string
+	AdvertisePort int
+	JoinAddrs     []string
+}
+
+// advertisedCluster is the payload published into the gossip group by each
+// node describing itself as a RemoteCluster to its peers.
+type advertisedCluster struct {
+	Id              string   `json:"id"`
+	ClusterName     string   `json:"cluster_name"`
+	Hostname        string   `json:"hostname"`
+	Topics          string   `json:"topics"`
+	TokenFingerprint string  `json:"token_fingerprint"`
+}
+
+// Discovery joins a memberlist/SWIM gossip group keyed by a shared cluster
+// name and pre-shared secret, and upserts RemoteCluster rows for every peer
+// it learns about. It is the federation analogue of the gossip-based
+// discovery already used for intra-cluster node discovery.
+type Discovery struct {
+	cfg     DiscoveryConfig
+	store   store.RemoteClusterStore
+	list    *memberlist.Memberlist
+	self    advertisedCluster
+	mut     sync.Mutex
+	stopped chan struct{}
+}
+
+// NewDiscovery creates a Discovery for the given config and store. Call
+// Start to join the gossip group and begin reconciling.
+func NewDiscovery(cfg DiscoveryConfig, rcStore store.RemoteClusterStore, self advertisedCluster) *Discovery {
+	return &Discovery{
+		cfg:     cfg,
+		store:   rcStore,
+		self:    self,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Start joins the memberlist gossip group and launches the background
+// reconciler that prunes peers memberlist has declared dead.
+func (d *Discovery) Start() error {
+	if !d.cfg.Enabled {
+		return nil
+	}
+
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = d.self.Id
+	conf.SecretKey = deriveGossipKey(d.cfg.ClusterName, d.cfg.SharedSecret)
+	conf.BindAddr = d.cfg.BindAddr
+	conf.BindPort = d.cfg.BindPort
+	if d.cfg.AdvertiseAddr != "" {
+		conf.AdvertiseAddr = d.cfg.AdvertiseAddr
+		conf.AdvertisePort = d.cfg.AdvertisePort
+	}
+	conf.Delegate = d
+	conf.Events = d
+
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		return errors.Wrap(err, "failed to create memberlist")
+	}
+	d.list = list
+
+	if len(d.cfg.JoinAddrs) > 0 {
+		if _, err := list.Join(d.cfg.JoinAddrs); err != nil {
+			return errors.Wrap(err, "failed to join gossip group")
+		}
+	}
+
+	go d.reconcileLoop()
+	return nil
+}
+
+// deriveGossipKey derives the 32-byte memberlist SecretKey used to encrypt
+// and authenticate gossip traffic from the configured cluster name and
+// pre-shared secret. Folding in clusterName gives distinct federations that
+// happen to share a SharedSecret distinct keys, rather than silently merging
+// their gossip groups.
+func deriveGossipKey(clusterName, sharedSecret string) []byte {
+	sum := sha256.Sum256([]byte(clusterName + "|" + sharedSecret))
+	return sum[:]
+}
+
+// Stop leaves the gossip group and halts the reconciler.
+func (d *Discovery) Stop() {
+	close(d.stopped)
+	if d.list != nil {
+		if err := d.list.Leave(5 * time.Second); err != nil {
+			mlog.Warn("error leaving memberlist gossip group", mlog.Err(err))
+		}
+		_ = d.list.Shutdown()
+	}
+}
+
+// NodeMeta implements memberlist.Delegate, publishing this node's
+// RemoteCluster metadata to peers.
+func (d *Discovery) NodeMeta(limit int) []byte {
+	b, err := json.Marshal(d.self)
+	if err != nil {
+		return nil
+	}
+	if len(b) > limit {
+		mlog.Warn("remote cluster gossip payload exceeds limit and is not published", mlog.Int("limit", limit))
+		return nil
+	}
+	return b
+}
+
+func (d *Discovery) NotifyMsg(b []byte)                           {}
+func (d *Discovery) GetBroadcasts(overhead, limit int) [][]byte   { return nil }
+func (d *Discovery) LocalState(join bool) []byte                  { return nil }
+func (d *Discovery) MergeRemoteState(buf []byte, join bool)       {}
+
+// NotifyJoin implements memberlist.EventDelegate, upserting a RemoteCluster
+// row whenever a peer advertises itself.
+func (d *Discovery) NotifyJoin(n *memberlist.Node) {
+	d.upsertFromNode(n)
+}
+
+// NotifyUpdate implements memberlist.EventDelegate.
+func (d *Discovery) NotifyUpdate(n *memberlist.Node) {
+	d.upsertFromNode(n)
+}
+
+// NotifyLeave implements memberlist.EventDelegate. Removal is left to the
+// reconciler, which also catches peers that time out without an explicit
+// leave message.
+func (d *Discovery) NotifyLeave(n *memberlist.Node) {}
+
+func (d *Discovery) upsertFromNode(n *memberlist.Node) {
+	var adv advertisedCluster
+	if err := json.Unmarshal(n.Meta, &adv); err != nil {
+		mlog.Warn("failed to parse remote cluster gossip payload", mlog.Err(err))
+		return
+	}
+	if adv.Id == "" || adv.Id == d.self.Id {
+		return
+	}
+	if adv.ClusterName != d.cfg.ClusterName {
+		mlog.Warn("rejecting gossip payload advertising a foreign cluster name",
+			mlog.String("remote_id", adv.Id), mlog.String("cluster_name", adv.ClusterName))
+		return
+	}
+	if adv.Id != n.Name {
+		mlog.Warn("rejecting gossip payload whose advertised id does not match the member's node name",
+			mlog.String("advertised_id", adv.Id), mlog.String("node_name", n.Name))
+		return
+	}
+
+	rc := &model.RemoteCluster{
+		Id:          adv.Id,
+		ClusterName: adv.ClusterName,
+		Hostname:    adv.Hostname,
+		Topics:      adv.Topics,
+	}
+	if _, err := d.store.Upsert(rc, DiscoverySourceGossip); err != nil {
+		mlog.Warn("failed to upsert gossip-discovered remote cluster", mlog.String("remote_id", adv.Id), mlog.Err(err))
+	}
+}
+
+// reconcileLoop periodically deletes RemoteCluster rows, discovered via
+// gossip, for peers memberlist no longer considers alive and whose
+// LastPingAt is older than RemoteOfflineAfterMillis.
+func (d *Discovery) reconcileLoop() {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.reconcileDeadPeers()
+		case <-d.stopped:
+			return
+		}
+	}
+}
+
+func (d *Discovery) reconcileDeadPeers() {
+	discovered, err := d.store.GetBySource(DiscoverySourceGossip)
+	if err != nil {
+		mlog.Warn("failed to fetch gossip-discovered remote clusters", mlog.Err(err))
+		return
+	}
+
+	alive := make(map[string]bool)
+	if d.list != nil {
+		for _, n := range d.list.Members() {
+			alive[n.Name] = true
+		}
+	}
+
+	cutoff := model.GetMillis() - model.RemoteOfflineAfterMillis
+	for _, rc := range discovered {
+		if alive[rc.Id] {
+			continue
+		}
+		if rc.LastPingAt > cutoff {
+			continue
+		}
+		if _, err := d.store.Delete(rc.Id); err != nil {
+			mlog.Warn("failed to delete dead gossip-discovered remote cluster", mlog.String("remote_id", rc.Id), mlog.Err(err))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package sqlstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+
+	tokenSaltLen  = 16
+	tokenNonceLen = 12
+)
+
+// deriveTokenKey derives a 32-byte AES-GCM data key from the configured
+// master passphrase and a per-row salt using scrypt.
+func deriveTokenKey(passphrase string, salt []byte) ([]byte, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive key")
+	}
+	return key, nil
+}
+
+// encryptToken encrypts plaintext with AES-GCM under a key freshly derived
+// from passphrase, generating a new random salt and nonce.
+func encryptToken(passphrase, plaintext string) (ciphertext, salt, nonce []byte, err error) {
+	if plaintext == "" {
+		return nil, nil, nil, nil
+	}
+
+	salt = make([]byte, tokenSaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to generate salt")
+	}
+
+	key, err := deriveTokenKey(passphrase, salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create gcm")
+	}
+
+	nonce = make([]byte, tokenNonceLen)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	ciphertext = gcm.Seal(nil, nonce, []byte(plaintext), nil)
+	return ciphertext, salt, nonce, nil
+}
+
+// decryptToken reverses encryptToken. A row with an empty salt is treated as
+// legacy plaintext (written before this encryption layer existed) and is
+// returned unchanged for backward compatibility.
+func decryptToken(passphrase string, ciphertext, salt, nonce []byte) (string, error) {
+	if len(salt) == 0 {
+		return string(ciphertext), nil
+	}
+
+	key, err := deriveTokenKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create gcm")
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decrypt token")
+	}
+	return string(plaintext), nil
+}
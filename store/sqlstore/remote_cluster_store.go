@@ -4,47 +4,381 @@
 package sqlstore
 
 import (
-	"fmt"
+	"database/sql"
+	"encoding/base64"
+	"net/url"
 	"strings"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/gorp"
 	"github.com/pkg/errors"
 
+	"github.com/mattermost/mattermost-server/v5/mlog"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/store"
 )
 
+// validateSiteURL returns an error if siteURL is non-empty and not a
+// well-formed absolute URL. An empty SiteURL is allowed for remote clusters
+// discovered before the remote has published its site address.
+func validateSiteURL(siteURL string) error {
+	if siteURL == "" {
+		return nil
+	}
+	u, err := url.Parse(siteURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.Errorf("invalid SiteURL: %s", siteURL)
+	}
+	return nil
+}
+
+// isNotFoundErr reports whether err ultimately wraps sql.ErrNoRows, i.e. a
+// lookup found no matching row rather than hitting a real database error.
+func isNotFoundErr(err error) bool {
+	return errors.Cause(err) == sql.ErrNoRows
+}
+
+// parseTopics splits the denormalized, space-padded Topics string (e.g.
+// " share incident ") into its individual, de-duplicated topic tokens. The
+// literal wildcard "*" is not a real topic and is never indexed in
+// RemoteClusterTopics; it is matched separately by GetByTopic/GetByTopics.
+// De-duplication matters because RemoteClusterTopics is keyed on
+// (RemoteClusterId, Topic): a repeated word in Topics, which the old
+// LIKE-based lookup tolerated, would otherwise violate that composite key.
+func parseTopics(topics string) []string {
+	if strings.TrimSpace(topics) == "*" {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(topics))
+	for _, topic := range strings.Fields(topics) {
+		if seen[topic] || topic == "*" {
+			continue
+		}
+		seen[topic] = true
+		unique = append(unique, topic)
+	}
+	return unique
+}
+
+// syncTopicsTable replaces a remote cluster's rows in RemoteClusterTopics to
+// match its current Topics string. It is called, within the same
+// transaction as the RemoteClusters write, by every path that writes Topics
+// so the indexed table never drifts from the denormalized column.
+func (s sqlRemoteClusterStore) syncTopicsTable(transaction *gorp.Transaction, remoteClusterId string, topics string) error {
+	delQuery, delArgs, err := s.getQueryBuilder().
+		Delete("RemoteClusterTopics").
+		Where(sq.Eq{"RemoteClusterId": remoteClusterId}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "remote_cluster_topics_delete_tosql")
+	}
+	if _, err := transaction.Exec(delQuery, delArgs...); err != nil {
+		return errors.Wrap(err, "failed to clear RemoteClusterTopics")
+	}
+
+	for _, topic := range parseTopics(topics) {
+		row := &remoteClusterTopic{RemoteClusterId: remoteClusterId, Topic: topic}
+		if err := transaction.Insert(row); err != nil {
+			return errors.Wrap(err, "failed to insert RemoteClusterTopics")
+		}
+	}
+	return nil
+}
+
+// remoteClusterTopic is the row type for the normalized RemoteClusterTopics
+// junction table, which replaces LIKE scans over the denormalized
+// RemoteClusters.Topics column with an indexed join.
+type remoteClusterTopic struct {
+	RemoteClusterId string
+	Topic           string
+}
+
+// remoteClusterWithTopic is used to scan the extra Topic column returned by
+// the GetByTopics join without affecting the RemoteClusters table mapping.
+type remoteClusterWithTopic struct {
+	model.RemoteCluster
+	Topic string
+}
+
 type sqlRemoteClusterStore struct {
 	SqlStore
+	encryptionPassphrase string
 }
 
 func newSqlRemoteClustersStore(sqlStore SqlStore) store.RemoteClusterStore {
-	s := &sqlRemoteClusterStore{sqlStore}
+	s := &sqlRemoteClusterStore{
+		SqlStore:             sqlStore,
+		encryptionPassphrase: sqlStore.GetConfig().SqlSettings.RemoteClusterEncryptionPassphrase(),
+	}
 
 	for _, db := range sqlStore.GetAllConns() {
+		topicsTable := db.AddTableWithName(remoteClusterTopic{}, "RemoteClusterTopics").SetKeys(false, "RemoteClusterId", "Topic")
+		topicsTable.ColMap("RemoteClusterId").SetMaxSize(26)
+		topicsTable.ColMap("Topic").SetMaxSize(128)
+
 		table := db.AddTableWithName(model.RemoteCluster{}, "RemoteClusters").SetKeys(false, "Id")
 		table.ColMap("Id").SetMaxSize(26)
+		table.ColMap("RemoteId").SetMaxSize(26)
+		table.ColMap("RemoteTeamId").SetMaxSize(26)
 		table.ColMap("ClusterName").SetMaxSize(64)
+		table.ColMap("DisplayName").SetMaxSize(64)
 		table.ColMap("Hostname").SetMaxSize(512)
-		table.ColMap("Token").SetMaxSize(26)
+		table.ColMap("SiteURL").SetMaxSize(512)
+		table.ColMap("CreatorId").SetMaxSize(26)
+		table.ColMap("Token").SetMaxSize(256)
+		table.ColMap("RemoteToken").SetMaxSize(256)
 		table.ColMap("Topics").SetMaxSize(512)
+		table.ColMap("Source").SetMaxSize(32)
+		table.ColMap("TokenSalt").SetMaxSize(32)
+		table.ColMap("TokenNonce").SetMaxSize(32)
+		table.ColMap("RemoteTokenSalt").SetMaxSize(32)
+		table.ColMap("RemoteTokenNonce").SetMaxSize(32)
+		table.ColMap("LastErrorMessage").SetMaxSize(512)
+	}
+
+	if err := s.migrateRemoteClusterTokenEncryption(); err != nil {
+		mlog.Critical("failed to migrate RemoteClusters token encryption columns", mlog.Err(err))
+	}
+	if err := s.migrateRemoteClusterSchema(); err != nil {
+		mlog.Critical("failed to migrate RemoteClusters schema columns", mlog.Err(err))
 	}
+	if err := s.migrateRemoteClusterTopicsTable(); err != nil {
+		mlog.Critical("failed to migrate RemoteClusterTopics table", mlog.Err(err))
+	}
+
 	return s
 }
 
+// encryptRow replaces the cleartext Token and RemoteToken fields of rc with
+// base64-encoded AES-GCM ciphertext. Token and RemoteToken each get their own
+// freshly generated salt and nonce (and therefore their own derived data
+// key) so neither reuses the other's key material; the salt/nonce pairs are
+// written into rc.Token{Salt,Nonce} and rc.RemoteToken{Salt,Nonce} so decryptRow
+// can reverse them later.
+func (s sqlRemoteClusterStore) encryptRow(rc *model.RemoteCluster) error {
+	cipherToken, salt, nonce, err := encryptToken(s.encryptionPassphrase, rc.Token)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt token")
+	}
+	cipherRemoteToken, remoteSalt, remoteNonce, err := encryptToken(s.encryptionPassphrase, rc.RemoteToken)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt remote token")
+	}
+
+	rc.Token = base64.StdEncoding.EncodeToString(cipherToken)
+	rc.TokenSalt = base64.StdEncoding.EncodeToString(salt)
+	rc.TokenNonce = base64.StdEncoding.EncodeToString(nonce)
+
+	rc.RemoteToken = base64.StdEncoding.EncodeToString(cipherRemoteToken)
+	rc.RemoteTokenSalt = base64.StdEncoding.EncodeToString(remoteSalt)
+	rc.RemoteTokenNonce = base64.StdEncoding.EncodeToString(remoteNonce)
+	return nil
+}
+
+// decryptRow reverses encryptRow in place. A row with an empty TokenSalt (or
+// RemoteTokenSalt) is legacy plaintext written before encryption was
+// introduced for that field and is left untouched.
+func (s sqlRemoteClusterStore) decryptRow(rc *model.RemoteCluster) error {
+	if rc.TokenSalt != "" {
+		salt, err := base64.StdEncoding.DecodeString(rc.TokenSalt)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode token salt")
+		}
+		nonce, err := base64.StdEncoding.DecodeString(rc.TokenNonce)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode token nonce")
+		}
+		cipherToken, err := base64.StdEncoding.DecodeString(rc.Token)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode token")
+		}
+		token, err := decryptToken(s.encryptionPassphrase, cipherToken, salt, nonce)
+		if err != nil {
+			return errors.Wrap(err, "failed to decrypt token")
+		}
+		rc.Token = token
+	}
+
+	if rc.RemoteTokenSalt != "" {
+		remoteSalt, err := base64.StdEncoding.DecodeString(rc.RemoteTokenSalt)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode remote token salt")
+		}
+		remoteNonce, err := base64.StdEncoding.DecodeString(rc.RemoteTokenNonce)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode remote token nonce")
+		}
+		cipherRemoteToken, err := base64.StdEncoding.DecodeString(rc.RemoteToken)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode remote token")
+		}
+		remoteToken, err := decryptToken(s.encryptionPassphrase, cipherRemoteToken, remoteSalt, remoteNonce)
+		if err != nil {
+			return errors.Wrap(err, "failed to decrypt remote token")
+		}
+		rc.RemoteToken = remoteToken
+	}
+
+	return nil
+}
+
+// decryptRows calls decryptRow for every row in list, returning on the first
+// error encountered.
+func (s sqlRemoteClusterStore) decryptRows(list []*model.RemoteCluster) error {
+	for _, rc := range list {
+		if err := s.decryptRow(rc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s sqlRemoteClusterStore) Save(remoteCluster *model.RemoteCluster) (*model.RemoteCluster, error) {
 	remoteCluster.PreSave()
+	if remoteCluster.Source == "" {
+		remoteCluster.Source = model.RemoteClusterSourceManual
+	}
 	if err := remoteCluster.IsValid(); err != nil {
 		return nil, err
 	}
+	if err := validateSiteURL(remoteCluster.SiteURL); err != nil {
+		return nil, err
+	}
 
-	if err := s.GetMaster().Insert(remoteCluster); err != nil {
+	plainToken, plainRemoteToken := remoteCluster.Token, remoteCluster.RemoteToken
+	if err := s.encryptRow(remoteCluster); err != nil {
+		return nil, err
+	}
+
+	transaction, err := s.GetMaster().Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer finalizeTransaction(transaction)
+
+	if err := transaction.Insert(remoteCluster); err != nil {
 		return nil, errors.Wrap(err, "failed to save RemoteCluster")
 	}
+	if err := s.syncTopicsTable(transaction, remoteCluster.Id, remoteCluster.Topics); err != nil {
+		return nil, err
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+
+	remoteCluster.Token, remoteCluster.RemoteToken = plainToken, plainRemoteToken
+	return remoteCluster, nil
+}
+
+// Upsert inserts a new RemoteCluster row, or updates the existing one if a row
+// with the same Id already exists. It is used by discovery sources (e.g. the
+// memberlist gossip discovery) that repeatedly learn about the same remote
+// cluster and need idempotent writes tagged with where they came from.
+func (s sqlRemoteClusterStore) Upsert(remoteCluster *model.RemoteCluster, source string) (*model.RemoteCluster, error) {
+	if remoteCluster.Id == "" {
+		return nil, errors.New("invalid remote cluster: id required for upsert")
+	}
+	remoteCluster.Source = source
+	if err := validateSiteURL(remoteCluster.SiteURL); err != nil {
+		return nil, err
+	}
+
+	if err := remoteCluster.IsValid(); err != nil {
+		return nil, err
+	}
+
+	existing, err := s.Get(remoteCluster.Id)
+	var isNew bool
+	switch {
+	case err == nil:
+		remoteCluster.CreateAt = existing.CreateAt
+		mergeRemoteClusterForUpsert(remoteCluster, existing)
+		remoteCluster.PreUpdate()
+	case isNotFoundErr(err):
+		isNew = true
+		remoteCluster.PreSave()
+	default:
+		return nil, errors.Wrap(err, "failed to check for existing RemoteCluster")
+	}
+
+	plainToken, plainRemoteToken := remoteCluster.Token, remoteCluster.RemoteToken
+
+	if err := s.encryptRow(remoteCluster); err != nil {
+		return nil, err
+	}
+
+	transaction, err := s.GetMaster().Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer finalizeTransaction(transaction)
+
+	if isNew {
+		if err := transaction.Insert(remoteCluster); err != nil {
+			return nil, errors.Wrap(err, "failed to insert RemoteCluster")
+		}
+	} else {
+		if _, err := transaction.Update(remoteCluster); err != nil {
+			return nil, errors.Wrap(err, "failed to update RemoteCluster")
+		}
+	}
+	if err := s.syncTopicsTable(transaction, remoteCluster.Id, remoteCluster.Topics); err != nil {
+		return nil, err
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+
+	remoteCluster.Token, remoteCluster.RemoteToken = plainToken, plainRemoteToken
 	return remoteCluster, nil
 }
 
+// mergeRemoteClusterForUpsert fills in fields left unset on an incoming
+// Upsert call with their existing stored values. Narrow callers such as the
+// memberlist gossip discovery (services/remotecluster.Discovery.
+// upsertFromNode) only populate Id/ClusterName/Hostname/Topics; without this,
+// their periodic re-upserts of an already-registered cluster would silently
+// wipe out a Token/SiteURL/etc. that was configured through a fuller path.
+func mergeRemoteClusterForUpsert(rc, existing *model.RemoteCluster) {
+	if rc.Token == "" {
+		rc.Token = existing.Token
+	}
+	if rc.RemoteToken == "" {
+		rc.RemoteToken = existing.RemoteToken
+	}
+	if rc.SiteURL == "" {
+		rc.SiteURL = existing.SiteURL
+	}
+	if rc.DisplayName == "" {
+		rc.DisplayName = existing.DisplayName
+	}
+	if rc.CreatorId == "" {
+		rc.CreatorId = existing.CreatorId
+	}
+	if rc.RemoteId == "" {
+		rc.RemoteId = existing.RemoteId
+	}
+	if rc.RemoteTeamId == "" {
+		rc.RemoteTeamId = existing.RemoteTeamId
+	}
+}
+
 func (s sqlRemoteClusterStore) Delete(remoteClusterId string) (bool, error) {
+	topicsQuery, topicsArgs, err := s.getQueryBuilder().
+		Delete("RemoteClusterTopics").
+		Where(sq.Eq{"RemoteClusterId": remoteClusterId}).
+		ToSql()
+	if err != nil {
+		return false, errors.Wrap(err, "delete_remote_cluster_topics_tosql")
+	}
+	if _, err := s.GetMaster().Exec(topicsQuery, topicsArgs...); err != nil {
+		return false, errors.Wrap(err, "failed to delete RemoteClusterTopics")
+	}
+
 	squery, args, err := s.getQueryBuilder().
 		Delete("RemoteClusters").
 		Where(sq.Eq{"Id": remoteClusterId}).
@@ -81,6 +415,9 @@ func (s sqlRemoteClusterStore) Get(remoteClusterId string) (*model.RemoteCluster
 	if err := s.GetReplica().SelectOne(&rc, queryString, args...); err != nil {
 		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
 	}
+	if err := s.decryptRow(&rc); err != nil {
+		return nil, err
+	}
 	return &rc, nil
 }
 
@@ -90,7 +427,10 @@ func (s sqlRemoteClusterStore) GetAll(includeOffline bool) ([]*model.RemoteClust
 		From("RemoteClusters")
 
 	if !includeOffline {
-		query = query.Where(sq.Gt{"LastPingAt": model.GetMillis() - model.RemoteOfflineAfterMillis})
+		query = query.Where(sq.Or{
+			sq.Gt{"LastPingSuccessAt": model.GetMillis() - model.RemoteOfflineAfterMillis},
+			sq.LtOrEq{"ConsecutiveFailures": offlineFailureThreshold},
+		})
 	}
 
 	queryString, args, err := query.ToSql()
@@ -102,6 +442,9 @@ func (s sqlRemoteClusterStore) GetAll(includeOffline bool) ([]*model.RemoteClust
 	if _, err := s.GetReplica().Select(&list, queryString, args...); err != nil {
 		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
 	}
+	if err := s.decryptRows(list); err != nil {
+		return nil, err
+	}
 	return list, nil
 }
 
@@ -112,7 +455,10 @@ func (s sqlRemoteClusterStore) GetAllNotInChannel(channelId string, inclOffline
 		Where("rc.Id NOT IN (SELECT scr.RemoteClusterId FROM SharedChannelRemotes scr WHERE scr.ChannelId = ?)", channelId)
 
 	if !inclOffline {
-		query = query.Where(sq.Gt{"rc.LastPingAt": model.GetMillis() - model.RemoteOfflineAfterMillis})
+		query = query.Where(sq.Or{
+			sq.Gt{"rc.LastPingSuccessAt": model.GetMillis() - model.RemoteOfflineAfterMillis},
+			sq.LtOrEq{"rc.ConsecutiveFailures": offlineFailureThreshold},
+		})
 	}
 
 	queryString, args, err := query.OrderBy("rc.ClusterName ASC").ToSql()
@@ -124,20 +470,27 @@ func (s sqlRemoteClusterStore) GetAllNotInChannel(channelId string, inclOffline
 	if _, err := s.GetReplica().Select(&list, queryString, args...); err != nil {
 		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
 	}
+	if err := s.decryptRows(list); err != nil {
+		return nil, err
+	}
 	return list, nil
 }
 
+// GetByTopic returns every RemoteCluster subscribed to topic, either
+// directly (via the indexed RemoteClusterTopics join) or via the wildcard
+// Topics value "*". This replaces the previous LIKE scan over the
+// denormalized, space-padded Topics column, which could not use an index.
 func (s sqlRemoteClusterStore) GetByTopic(topic string) ([]*model.RemoteCluster, error) {
 	trimmed := strings.TrimSpace(topic)
 	if trimmed == "" || trimmed == "*" {
 		return nil, errors.New("invalid topic")
 	}
 
-	queryTopic := fmt.Sprintf("%% %s %%", trimmed)
 	query := s.getQueryBuilder().
-		Select("rc.*").
+		Select("DISTINCT rc.*").
 		From("RemoteClusters rc").
-		Where(sq.Or{sq.Like{"rc.Topics": queryTopic}, sq.Eq{"rc.Topics": "*"}})
+		LeftJoin("RemoteClusterTopics rct ON rct.RemoteClusterId = rc.Id").
+		Where(sq.Or{sq.Eq{"rct.Topic": trimmed}, sq.Eq{"rc.Topics": "*"}})
 
 	queryString, args, err := query.ToSql()
 	if err != nil {
@@ -148,9 +501,84 @@ func (s sqlRemoteClusterStore) GetByTopic(topic string) ([]*model.RemoteCluster,
 	if _, err := s.GetReplica().Select(&list, queryString, args...); err != nil {
 		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
 	}
+	if err := s.decryptRows(list); err != nil {
+		return nil, err
+	}
 	return list, nil
 }
 
+// GetByTopics resolves many topics at once, returning a map keyed by topic of
+// the RemoteClusters subscribed to it. RemoteClusters with the wildcard
+// Topics value "*" are included under every requested topic. It issues two
+// queries however many topics are requested (one join over
+// RemoteClusterTopics, one for wildcard rows), not a single one.
+func (s sqlRemoteClusterStore) GetByTopics(topics []string) (map[string][]*model.RemoteCluster, error) {
+	result := make(map[string][]*model.RemoteCluster, len(topics))
+	for _, topic := range topics {
+		trimmed := strings.TrimSpace(topic)
+		if trimmed == "" || trimmed == "*" {
+			return nil, errors.New("invalid topic")
+		}
+		result[trimmed] = nil
+	}
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	trimmedTopics := make([]string, 0, len(result))
+	for topic := range result {
+		trimmedTopics = append(trimmedTopics, topic)
+	}
+
+	joinQuery := s.getQueryBuilder().
+		Select("rc.*", "rct.Topic").
+		From("RemoteClusters rc").
+		Join("RemoteClusterTopics rct ON rct.RemoteClusterId = rc.Id").
+		Where(sq.Eq{"rct.Topic": trimmedTopics})
+
+	joinQueryString, joinArgs, err := joinQuery.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getbytopics_join_tosql")
+	}
+
+	var joined []*remoteClusterWithTopic
+	if _, err := s.GetReplica().Select(&joined, joinQueryString, joinArgs...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+
+	for _, row := range joined {
+		rc := row.RemoteCluster
+		if err := s.decryptRow(&rc); err != nil {
+			return nil, err
+		}
+		result[row.Topic] = append(result[row.Topic], &rc)
+	}
+
+	wildcardQuery := s.getQueryBuilder().
+		Select("*").
+		From("RemoteClusters").
+		Where(sq.Eq{"Topics": "*"})
+
+	wildcardQueryString, wildcardArgs, err := wildcardQuery.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getbytopics_wildcard_tosql")
+	}
+
+	var wildcards []*model.RemoteCluster
+	if _, err := s.GetReplica().Select(&wildcards, wildcardQueryString, wildcardArgs...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+	if err := s.decryptRows(wildcards); err != nil {
+		return nil, err
+	}
+
+	for topic := range result {
+		result[topic] = append(result[topic], wildcards...)
+	}
+
+	return result, nil
+}
+
 func (s sqlRemoteClusterStore) UpdateTopics(remoteClusterid string, topics string) (*model.RemoteCluster, error) {
 	rc, err := s.Get(remoteClusterid)
 	if err != nil {
@@ -160,25 +588,334 @@ func (s sqlRemoteClusterStore) UpdateTopics(remoteClusterid string, topics strin
 
 	rc.PreUpdate()
 
-	if _, err = s.GetMaster().Update(rc); err != nil {
+	plainToken, plainRemoteToken := rc.Token, rc.RemoteToken
+	if err := s.encryptRow(rc); err != nil {
 		return nil, err
 	}
+
+	transaction, err := s.GetMaster().Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer finalizeTransaction(transaction)
+
+	if _, err := transaction.Update(rc); err != nil {
+		return nil, err
+	}
+	if err := s.syncTopicsTable(transaction, rc.Id, topics); err != nil {
+		return nil, err
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit transaction")
+	}
+
+	rc.Token, rc.RemoteToken = plainToken, plainRemoteToken
 	return rc, nil
 }
 
-func (s sqlRemoteClusterStore) SetLastPingAt(remoteClusterId string) error {
+func (s sqlRemoteClusterStore) GetByRemoteId(remoteId string) (*model.RemoteCluster, error) {
+	query := s.getQueryBuilder().
+		Select("*").
+		From("RemoteClusters").
+		Where(sq.Eq{"RemoteId": remoteId})
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getbyremoteid_tosql")
+	}
+
+	var rc model.RemoteCluster
+	if err := s.GetReplica().SelectOne(&rc, queryString, args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+	if err := s.decryptRow(&rc); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func (s sqlRemoteClusterStore) GetByName(name string) (*model.RemoteCluster, error) {
+	query := s.getQueryBuilder().
+		Select("*").
+		From("RemoteClusters").
+		Where(sq.Eq{"ClusterName": name})
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getbyname_tosql")
+	}
+
+	var rc model.RemoteCluster
+	if err := s.GetReplica().SelectOne(&rc, queryString, args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+	if err := s.decryptRow(&rc); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func (s sqlRemoteClusterStore) GetForUser(userId string, includeOffline bool) ([]*model.RemoteCluster, error) {
+	query := s.getQueryBuilder().
+		Select("*").
+		From("RemoteClusters").
+		Where(sq.Eq{"CreatorId": userId})
+
+	if !includeOffline {
+		query = query.Where(sq.Or{
+			sq.Gt{"LastPingSuccessAt": model.GetMillis() - model.RemoteOfflineAfterMillis},
+			sq.LtOrEq{"ConsecutiveFailures": offlineFailureThreshold},
+		})
+	}
+
+	queryString, args, err := query.OrderBy("ClusterName ASC").ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getforuser_tosql")
+	}
+
+	var list []*model.RemoteCluster
+	if _, err := s.GetReplica().Select(&list, queryString, args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+	if err := s.decryptRows(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s sqlRemoteClusterStore) GetBySource(source string) ([]*model.RemoteCluster, error) {
+	query := s.getQueryBuilder().
+		Select("*").
+		From("RemoteClusters").
+		Where(sq.Eq{"Source": source})
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getbysource_tosql")
+	}
+
+	var list []*model.RemoteCluster
+	if _, err := s.GetReplica().Select(&list, queryString, args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+	if err := s.decryptRows(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+const (
+	pingBaseBackoffMillis   = 5 * 1000
+	pingMaxBackoffMillis    = 15 * 60 * 1000
+	pingJitterMillis        = 2 * 1000
+	offlineFailureThreshold = 5
+)
+
+// RecordPingSuccess records a successful ping to the remote cluster,
+// resetting its failure/backoff state and stamping LastPingAt (used for
+// display purposes) and LastPingSuccessAt.
+func (s sqlRemoteClusterStore) RecordPingSuccess(remoteClusterId string, rttMillis int64) error {
+	now := model.GetMillis()
+
+	query := s.getQueryBuilder().
+		Update("RemoteClusters").
+		Set("LastPingAt", now).
+		Set("LastPingSuccessAt", now).
+		Set("ConsecutiveFailures", 0).
+		Set("NextRetryAt", 0).
+		Set("LastErrorMessage", "").
+		Where(sq.Eq{"Id": remoteClusterId})
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "remote_cluster_record_ping_success_tosql")
+	}
+
+	if _, err := s.GetMaster().Exec(queryString, args...); err != nil {
+		return errors.Wrap(err, "failed to record ping success for RemoteCluster")
+	}
+	return nil
+}
+
+// RecordPingFailure records a failed ping attempt, incrementing
+// ConsecutiveFailures and scheduling NextRetryAt using exponential backoff
+// with jitter: base * 2^failures, capped at pingMaxBackoffMillis.
+func (s sqlRemoteClusterStore) RecordPingFailure(remoteClusterId string, errMsg string) error {
+	rc, err := s.Get(remoteClusterId)
+	if err != nil {
+		return err
+	}
+
+	now := model.GetMillis()
+	failures := rc.ConsecutiveFailures + 1
+
+	backoff := int64(pingBaseBackoffMillis) << uint(failures)
+	if backoff <= 0 || backoff > pingMaxBackoffMillis {
+		backoff = pingMaxBackoffMillis
+	}
+	jitter := now % pingJitterMillis
+	nextRetryAt := now + backoff + jitter
+
 	query := s.getQueryBuilder().
 		Update("RemoteClusters").
-		Set("LastPingAt", model.GetMillis()).
+		Set("LastPingAt", now).
+		Set("LastPingErrorAt", now).
+		Set("ConsecutiveFailures", failures).
+		Set("NextRetryAt", nextRetryAt).
+		Set("LastErrorMessage", errMsg).
 		Where(sq.Eq{"Id": remoteClusterId})
 
 	queryString, args, err := query.ToSql()
 	if err != nil {
-		return errors.Wrap(err, "remote_cluster_tosql")
+		return errors.Wrap(err, "remote_cluster_record_ping_failure_tosql")
 	}
 
 	if _, err := s.GetMaster().Exec(queryString, args...); err != nil {
-		return errors.Wrap(err, "failed to update RemoteCluster")
+		return errors.Wrap(err, "failed to record ping failure for RemoteCluster")
 	}
 	return nil
 }
+
+// GetDueForPing returns up to limit RemoteClusters whose NextRetryAt has
+// passed (or which have never been pinged), so the syncing service can
+// avoid hammering peers that are backing off.
+func (s sqlRemoteClusterStore) GetDueForPing(now int64, limit int) ([]*model.RemoteCluster, error) {
+	query := s.getQueryBuilder().
+		Select("*").
+		From("RemoteClusters").
+		Where(sq.LtOrEq{"NextRetryAt": now}).
+		OrderBy("NextRetryAt ASC").
+		Limit(uint64(limit))
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "remote_cluster_getdueforping_tosql")
+	}
+
+	var list []*model.RemoteCluster
+	if _, err := s.GetReplica().Select(&list, queryString, args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to find RemoteCluster")
+	}
+	if err := s.decryptRows(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+const rotateEncryptionKeyBatchSize = 100
+
+// RotateEncryptionKey re-encrypts every RemoteCluster row's Token and
+// RemoteToken under a data key derived from newPass, replacing the one
+// derived from oldPass. Rows are processed in batches, each wrapped in its
+// own transaction so a failure partway through only leaves a prefix of rows
+// rotated rather than corrupting the whole table.
+func (s sqlRemoteClusterStore) RotateEncryptionKey(oldPass, newPass string) error {
+	oldStore := sqlRemoteClusterStore{SqlStore: s.SqlStore, encryptionPassphrase: oldPass}
+	newStore := sqlRemoteClusterStore{SqlStore: s.SqlStore, encryptionPassphrase: newPass}
+
+	offset := 0
+	for {
+		query := s.getQueryBuilder().
+			Select("*").
+			From("RemoteClusters").
+			OrderBy("Id ASC").
+			Limit(rotateEncryptionKeyBatchSize).
+			Offset(uint64(offset))
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return errors.Wrap(err, "remote_cluster_rotate_encryption_key_tosql")
+		}
+
+		var batch []*model.RemoteCluster
+		if _, err := s.GetReplica().Select(&batch, queryString, args...); err != nil {
+			return errors.Wrap(err, "failed to fetch RemoteCluster batch for rotation")
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		transaction, err := s.GetMaster().Begin()
+		if err != nil {
+			return errors.Wrap(err, "failed to begin rotation transaction")
+		}
+
+		for _, rc := range batch {
+			if err := oldStore.decryptRow(rc); err != nil {
+				transaction.Rollback()
+				return errors.Wrapf(err, "failed to decrypt RemoteCluster %s during rotation", rc.Id)
+			}
+			if err := newStore.encryptRow(rc); err != nil {
+				transaction.Rollback()
+				return errors.Wrapf(err, "failed to re-encrypt RemoteCluster %s during rotation", rc.Id)
+			}
+			if _, err := transaction.Update(rc); err != nil {
+				transaction.Rollback()
+				return errors.Wrapf(err, "failed to persist rotated RemoteCluster %s", rc.Id)
+			}
+		}
+
+		if err := transaction.Commit(); err != nil {
+			return errors.Wrap(err, "failed to commit rotation transaction")
+		}
+
+		offset += len(batch)
+	}
+}
+
+const backfillTopicsBatchSize = 100
+
+// backfillRemoteClusterTopics parses every existing RemoteClusters.Topics
+// string and populates the new RemoteClusterTopics table accordingly. It is
+// run by migrateRemoteClusterTopicsTable on every store construction; between
+// runs syncTopicsTable keeps the two in sync on every write.
+func (s sqlRemoteClusterStore) backfillRemoteClusterTopics() error {
+	offset := 0
+	for {
+		query := s.getQueryBuilder().
+			Select("Id", "Topics").
+			From("RemoteClusters").
+			OrderBy("Id ASC").
+			Limit(backfillTopicsBatchSize).
+			Offset(uint64(offset))
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return errors.Wrap(err, "remote_cluster_backfill_topics_tosql")
+		}
+
+		var batch []*remoteClusterTopicsRow
+		if _, err := s.GetReplica().Select(&batch, queryString, args...); err != nil {
+			return errors.Wrap(err, "failed to fetch RemoteCluster batch for topics backfill")
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		transaction, err := s.GetMaster().Begin()
+		if err != nil {
+			return errors.Wrap(err, "failed to begin backfill transaction")
+		}
+
+		for _, row := range batch {
+			if err := s.syncTopicsTable(transaction, row.Id, row.Topics); err != nil {
+				transaction.Rollback()
+				return errors.Wrapf(err, "failed to backfill topics for RemoteCluster %s", row.Id)
+			}
+		}
+
+		if err := transaction.Commit(); err != nil {
+			return errors.Wrap(err, "failed to commit backfill transaction")
+		}
+
+		offset += len(batch)
+	}
+}
+
+// remoteClusterTopicsRow is a minimal projection of RemoteClusters used only
+// by backfillRemoteClusterTopics.
+type remoteClusterTopicsRow struct {
+	Id     string
+	Topics string
+}
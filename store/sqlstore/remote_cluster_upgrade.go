@@ -0,0 +1,61 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package sqlstore
+
+// migrateRemoteClusterTokenEncryption adds the columns needed to store
+// envelope-encrypted Token/RemoteToken values on an existing RemoteClusters
+// table. gorp's ColMap/AddTableWithName only shapes CREATE TABLE for a brand
+// new table; it does not ALTER a table that already exists, so these columns
+// must be added explicitly for installations upgrading from a release that
+// predates encryption-at-rest.
+func (s sqlRemoteClusterStore) migrateRemoteClusterTokenEncryption() error {
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "TokenSalt", "VARCHAR(32)", "VARCHAR(32)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "TokenNonce", "VARCHAR(32)", "VARCHAR(32)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "RemoteTokenSalt", "VARCHAR(32)", "VARCHAR(32)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "RemoteTokenNonce", "VARCHAR(32)", "VARCHAR(32)")
+	return nil
+}
+
+// migrateRemoteClusterHealth adds the ping health/backoff columns used by
+// RecordPingSuccess, RecordPingFailure and GetDueForPing to an existing
+// RemoteClusters table.
+func (s sqlRemoteClusterStore) migrateRemoteClusterHealth() error {
+	s.CreateColumnIfNotExists("RemoteClusters", "LastPingSuccessAt", "bigint", "bigint", "0")
+	s.CreateColumnIfNotExists("RemoteClusters", "LastPingErrorAt", "bigint", "bigint", "0")
+	s.CreateColumnIfNotExists("RemoteClusters", "ConsecutiveFailures", "bigint", "bigint", "0")
+	s.CreateColumnIfNotExists("RemoteClusters", "NextRetryAt", "bigint", "bigint", "0")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "LastErrorMessage", "VARCHAR(512)", "VARCHAR(512)")
+	return nil
+}
+
+// migrateRemoteClusterSchema adds the remaining columns introduced as the
+// RemoteCluster model grew to match upstream: Source (manual vs
+// gossip-discovered), and the full RemoteId/RemoteTeamId/SiteURL/
+// DisplayName/CreatorId set used by GetByRemoteId/GetByName/GetForUser.
+func (s sqlRemoteClusterStore) migrateRemoteClusterSchema() error {
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "Source", "VARCHAR(32)", "VARCHAR(32)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "RemoteId", "VARCHAR(26)", "VARCHAR(26)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "RemoteTeamId", "VARCHAR(26)", "VARCHAR(26)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "SiteURL", "VARCHAR(512)", "VARCHAR(512)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "DisplayName", "VARCHAR(64)", "VARCHAR(64)")
+	s.CreateColumnIfNotExistsNoDefault("RemoteClusters", "CreatorId", "VARCHAR(26)", "VARCHAR(26)")
+
+	if err := s.migrateRemoteClusterHealth(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// migrateRemoteClusterTopicsTable creates the composite index backing
+// GetByTopic/GetByTopics (gorp's SetKeys only creates the primary key, not
+// this secondary index) and backfills the table from every existing
+// RemoteClusters.Topics value, so rows written before this migration don't
+// silently disappear from topic lookups. backfillRemoteClusterTopics is
+// idempotent — syncTopicsTable replaces a cluster's rows wholesale — so it
+// is safe to run on every startup rather than only the first time.
+func (s sqlRemoteClusterStore) migrateRemoteClusterTopicsTable() error {
+	s.CreateCompositeIndexIfNotExists("idx_remoteclustertopics_topic_remoteclusterid", "RemoteClusterTopics", []string{"Topic", "RemoteClusterId"})
+
+	return s.backfillRemoteClusterTopics()
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2015-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package storetest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/store"
+)
+
+// TestRemoteClusterStore runs the RemoteClusterStore test suite against ss.
+// It is called once per supported database driver from
+// sqlstore/remote_cluster_store_test.go.
+func TestRemoteClusterStore(t *testing.T, ss store.Store) {
+	t.Run("TokenEncryptionRoundTrip", func(t *testing.T) { testRemoteClusterTokenEncryptionRoundTrip(t, ss) })
+	t.Run("GetByTopicWildcard", func(t *testing.T) { testRemoteClusterGetByTopicWildcard(t, ss) })
+	t.Run("PingBackoff", func(t *testing.T) { testRemoteClusterPingBackoff(t, ss) })
+}
+
+func testRemoteClusterTokenEncryptionRoundTrip(t *testing.T, ss store.Store) {
+	rc := &model.RemoteCluster{
+		ClusterName: "round-trip",
+		Hostname:    "round-trip.example.com",
+		Token:       model.NewId(),
+		RemoteToken: model.NewId(),
+		Topics:      "share incident",
+	}
+
+	plainToken, plainRemoteToken := rc.Token, rc.RemoteToken
+
+	saved, err := ss.RemoteCluster().Save(rc)
+	require.NoError(t, err)
+	require.Equal(t, plainToken, saved.Token, "Save must return the caller's plaintext Token, not ciphertext")
+	require.Equal(t, plainRemoteToken, saved.RemoteToken, "Save must return the caller's plaintext RemoteToken, not ciphertext")
+
+	fetched, err := ss.RemoteCluster().Get(saved.Id)
+	require.NoError(t, err)
+	require.Equal(t, plainToken, fetched.Token, "Get must decrypt Token back to the original plaintext")
+	require.Equal(t, plainRemoteToken, fetched.RemoteToken, "Get must decrypt RemoteToken back to the original plaintext, under its own key")
+}
+
+func testRemoteClusterGetByTopicWildcard(t *testing.T, ss store.Store) {
+	specific := &model.RemoteCluster{
+		ClusterName: "specific-topic",
+		Hostname:    "specific.example.com",
+		Token:       model.NewId(),
+		Topics:      "share",
+	}
+	_, err := ss.RemoteCluster().Save(specific)
+	require.NoError(t, err)
+
+	wildcard := &model.RemoteCluster{
+		ClusterName: "wildcard-topic",
+		Hostname:    "wildcard.example.com",
+		Token:       model.NewId(),
+		Topics:      "*",
+	}
+	_, err = ss.RemoteCluster().Save(wildcard)
+	require.NoError(t, err)
+
+	list, err := ss.RemoteCluster().GetByTopic("share")
+	require.NoError(t, err)
+
+	ids := make(map[string]bool)
+	for _, rc := range list {
+		ids[rc.Id] = true
+	}
+	require.True(t, ids[specific.Id], "cluster subscribed to the exact topic must be returned")
+	require.True(t, ids[wildcard.Id], "cluster subscribed via the wildcard topic must be returned for any topic query")
+}
+
+func testRemoteClusterPingBackoff(t *testing.T, ss store.Store) {
+	rc := &model.RemoteCluster{
+		ClusterName: "backoff-test",
+		Hostname:    "backoff.example.com",
+		Token:       model.NewId(),
+	}
+	saved, err := ss.RemoteCluster().Save(rc)
+	require.NoError(t, err)
+
+	err = ss.RemoteCluster().RecordPingFailure(saved.Id, "connection refused")
+	require.NoError(t, err)
+
+	afterFailure, err := ss.RemoteCluster().Get(saved.Id)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), afterFailure.ConsecutiveFailures)
+	require.Greater(t, afterFailure.NextRetryAt, int64(0))
+	require.Equal(t, "connection refused", afterFailure.LastErrorMessage)
+
+	err = ss.RemoteCluster().RecordPingSuccess(saved.Id, 42)
+	require.NoError(t, err)
+
+	afterSuccess, err := ss.RemoteCluster().Get(saved.Id)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), afterSuccess.ConsecutiveFailures)
+	require.Equal(t, int64(0), afterSuccess.NextRetryAt)
+	require.Equal(t, "", afterSuccess.LastErrorMessage)
+}